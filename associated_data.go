@@ -0,0 +1,5 @@
+package doubleratchet
+
+// AssociatedData is additional data covered by the authentication but not by the encryption of a message.
+// It's commonly used to bind a message to some higher-level context (e.g. the parties' identity keys).
+type AssociatedData []byte
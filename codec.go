@@ -0,0 +1,106 @@
+package doubleratchet
+
+import "fmt"
+
+const envelopeVersion = 1
+
+// Codec turns a Message into a single wire-format blob and back. It's orthogonal to
+// MessageHeader.EncodeWithAD, which keeps encoding the header into the AEAD associated data the
+// same way regardless of which Codec is selected.
+type Codec interface {
+	Encode(m Message) ([]byte, error)
+	Decode(b []byte) (Message, error)
+}
+
+// WithCodec overrides the default Codec used by State.Encode/State.Decode.
+func WithCodec(codec Codec) Option {
+	return func(s *state) error {
+		s.Codec = codec
+		return nil
+	}
+}
+
+// protoCodec is the default Codec: Message.Marshal/UnmarshalMessage implementing the Envelope
+// described in message.proto.
+type protoCodec struct{}
+
+func (protoCodec) Encode(m Message) ([]byte, error) { return m.Marshal() }
+func (protoCodec) Decode(b []byte) (Message, error) { return UnmarshalMessage(b) }
+
+// Marshal encodes m as the versioned Envelope described in message.proto.
+func (m Message) Marshal() ([]byte, error) {
+	var header, headerIV []byte
+	if m.EncHeader != nil {
+		header = m.EncHeader
+		headerIV = []byte{1} // marks header as encrypted; EncryptHeader's AEAD already embeds its own nonce.
+	} else {
+		var err error
+		header, err = m.Header.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal header: %s", err)
+		}
+	}
+
+	var buf []byte
+	buf = appendVarintField(buf, 1, envelopeVersion)
+	buf = appendBytesField(buf, 2, header)
+	buf = appendBytesField(buf, 3, m.Ciphertext)
+	if headerIV != nil {
+		buf = appendBytesField(buf, 4, headerIV)
+	}
+	return buf, nil
+}
+
+// UnmarshalMessage decodes a blob produced by Message.Marshal.
+func UnmarshalMessage(b []byte) (Message, error) {
+	fields, err := parseProtoFields(b)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse envelope: %s", err)
+	}
+	version, _ := fields[1].(uint64)
+	if version != envelopeVersion {
+		return Message{}, fmt.Errorf("unsupported envelope version: %d", version)
+	}
+	header, _ := fields[2].([]byte)
+	ciphertext, _ := fields[3].([]byte)
+
+	m := Message{Ciphertext: ciphertext}
+	if _, headerEncrypted := fields[4]; headerEncrypted {
+		m.EncHeader = header
+		return m, nil
+	}
+	h, err := UnmarshalMessageHeader(header)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to unmarshal header: %s", err)
+	}
+	m.Header = h
+	return m, nil
+}
+
+// Marshal encodes h as the MessageHeader message described in message.proto.
+func (h MessageHeader) Marshal() ([]byte, error) {
+	var buf []byte
+	buf = appendBytesField(buf, 1, h.DH[:])
+	buf = appendVarintField(buf, 2, uint64(h.N))
+	buf = appendVarintField(buf, 3, uint64(h.PN))
+	return buf, nil
+}
+
+// UnmarshalMessageHeader decodes a blob produced by MessageHeader.Marshal.
+func UnmarshalMessageHeader(b []byte) (MessageHeader, error) {
+	fields, err := parseProtoFields(b)
+	if err != nil {
+		return MessageHeader{}, fmt.Errorf("failed to parse header: %s", err)
+	}
+	dh, _ := fields[1].([]byte)
+	if len(dh) != 32 {
+		return MessageHeader{}, fmt.Errorf("invalid dh length: %d", len(dh))
+	}
+	var h MessageHeader
+	copy(h.DH[:], dh)
+	n, _ := fields[2].(uint64)
+	pn, _ := fields[3].(uint64)
+	h.N = uint(n)
+	h.PN = uint(pn)
+	return h, nil
+}
@@ -0,0 +1,99 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMessageHeaderMarshalRoundTrip(t *testing.T) {
+	h := MessageHeader{DH: [32]byte{1, 2, 3}, N: 7, PN: 42}
+
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal header: %s", err)
+	}
+	got, err := UnmarshalMessageHeader(b)
+	if err != nil {
+		t.Fatalf("failed to unmarshal header: %s", err)
+	}
+	if got != h {
+		t.Fatalf("got %+v, want %+v", got, h)
+	}
+}
+
+func TestMessageMarshalRoundTripCleartextHeader(t *testing.T) {
+	m := Message{
+		Header:     MessageHeader{DH: [32]byte{4, 5, 6}, N: 1, PN: 0},
+		Ciphertext: []byte("ciphertext"),
+	}
+
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal message: %s", err)
+	}
+	got, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatalf("failed to unmarshal message: %s", err)
+	}
+	if got.Header != m.Header {
+		t.Fatalf("header: got %+v, want %+v", got.Header, m.Header)
+	}
+	if !bytes.Equal(got.Ciphertext, m.Ciphertext) {
+		t.Fatalf("ciphertext: got %q, want %q", got.Ciphertext, m.Ciphertext)
+	}
+	if got.EncHeader != nil {
+		t.Fatalf("got EncHeader %x, want nil", got.EncHeader)
+	}
+}
+
+func TestMessageMarshalRoundTripEncryptedHeader(t *testing.T) {
+	m := Message{
+		EncHeader:  []byte("encrypted-header-bytes"),
+		Ciphertext: []byte("ciphertext"),
+	}
+
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal message: %s", err)
+	}
+	got, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatalf("failed to unmarshal message: %s", err)
+	}
+	if !bytes.Equal(got.EncHeader, m.EncHeader) {
+		t.Fatalf("EncHeader: got %x, want %x", got.EncHeader, m.EncHeader)
+	}
+	if !bytes.Equal(got.Ciphertext, m.Ciphertext) {
+		t.Fatalf("ciphertext: got %q, want %q", got.Ciphertext, m.Ciphertext)
+	}
+	if got.Header != (MessageHeader{}) {
+		t.Fatalf("got Header %+v, want zero value", got.Header)
+	}
+}
+
+func TestCodecRoundTripViaState(t *testing.T) {
+	alice, bob := newTestPair(t)
+	ad := AssociatedData("ad")
+
+	m, err := alice.RatchetEncrypt([]byte("hello"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt: %s", err)
+	}
+
+	b, err := alice.Encode(m)
+	if err != nil {
+		t.Fatalf("failed to encode message: %s", err)
+	}
+	decoded, err := bob.Decode(b)
+	if err != nil {
+		t.Fatalf("failed to decode message: %s", err)
+	}
+
+	pt, err := bob.RatchetDecrypt(decoded, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(pt, []byte("hello")) {
+		t.Fatalf("bob got %q, want %q", pt, "hello")
+	}
+}
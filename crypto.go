@@ -0,0 +1,36 @@
+package doubleratchet
+
+// Crypto is a cryptography supplement for the library. Default implementations of the functions
+// are based on recommendations specified in https://signal.org/docs/specifications/doubleratchet/.
+type Crypto interface {
+	// GenerateDH generates a new Diffie-Hellman key pair.
+	GenerateDH() (DHPair, error)
+
+	// LoadDH rebuilds a Diffie-Hellman key pair from a previously generated private key,
+	// e.g. one restored from a StateSnapshot.
+	LoadDH(privateKey [32]byte) (DHPair, error)
+
+	// DH returns the output from the Diffie-Hellman calculation between the private key from the
+	// key pair dhPair and the public key dhPub.
+	DH(dhPair DHPair, dhPub [32]byte) [32]byte
+
+	// KdfRK returns a pair (32-byte root key, 32-byte chain key) from the root key rk and the
+	// Diffie-Hellman output dhOut.
+	KdfRK(rk, dhOut [32]byte) (rootKey, chainKey [32]byte)
+
+	// KdfCK returns a pair (32-byte chain key, 32-byte message key) from the chain key ck.
+	KdfCK(ck [32]byte) (chainKey, msgKey [32]byte)
+
+	// Encrypt uses the message key mk to encrypt plaintext with associated data ad.
+	Encrypt(mk [32]byte, plaintext, ad []byte) (ciphertext []byte)
+
+	// Decrypt uses the message key mk to decrypt ciphertext with associated data ad.
+	Decrypt(mk [32]byte, ciphertext, ad []byte) (plaintext []byte, err error)
+
+	// EncryptHeader uses the header key hk to encrypt the header.
+	EncryptHeader(hk [32]byte, header []byte) (encHeader []byte)
+
+	// DecryptHeader uses the header key hk to decrypt the header. It must return an error
+	// whenever encHeader wasn't produced with hk, so that callers can use it to probe keys.
+	DecryptHeader(hk [32]byte, encHeader []byte) (header []byte, err error)
+}
@@ -0,0 +1,140 @@
+package doubleratchet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// DefaultCrypto is a default implementation of Crypto using Curve25519, HKDF(SHA-256) and AES-256-GCM,
+// following the recommendations in the Double Ratchet spec.
+type DefaultCrypto struct{}
+
+// dhPair is the default DHPair implementation based on Curve25519.
+type dhPair struct {
+	privateKey [32]byte
+	publicKey  [32]byte
+}
+
+func (p dhPair) PrivateKey() [32]byte { return p.privateKey }
+func (p dhPair) PublicKey() [32]byte  { return p.publicKey }
+
+// GenerateDH generates a new Curve25519 key pair.
+func (c DefaultCrypto) GenerateDH() (DHPair, error) {
+	var priv [32]byte
+	if _, err := io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %s", err)
+	}
+	priv[0] &= 248
+	priv[31] &= 127
+	priv[31] |= 64
+
+	pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute public key: %s", err)
+	}
+
+	var pair dhPair
+	pair.privateKey = priv
+	copy(pair.publicKey[:], pub)
+	return pair, nil
+}
+
+// LoadDH rebuilds a Curve25519 key pair from a previously generated private key.
+func (c DefaultCrypto) LoadDH(privateKey [32]byte) (DHPair, error) {
+	pub, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute public key: %s", err)
+	}
+	var pair dhPair
+	pair.privateKey = privateKey
+	copy(pair.publicKey[:], pub)
+	return pair, nil
+}
+
+// DH returns the Curve25519 shared secret between dhPair and dhPub.
+func (c DefaultCrypto) DH(dhPair DHPair, dhPub [32]byte) [32]byte {
+	priv := dhPair.PrivateKey()
+	shared, err := curve25519.X25519(priv[:], dhPub[:])
+	if err != nil {
+		// Only low-order points can trigger this, which the spec allows us to treat as fatal.
+		panic(fmt.Sprintf("failed to compute dh: %s", err))
+	}
+	var out [32]byte
+	copy(out[:], shared)
+	return out
+}
+
+// KdfRK derives the next root key and chain key from the current root key and a DH output.
+func (c DefaultCrypto) KdfRK(rk, dhOut [32]byte) (rootKey, chainKey [32]byte) {
+	r := hkdf.New(sha256.New, dhOut[:], rk[:], []byte("DoubleRatchetRK"))
+	io.ReadFull(r, rootKey[:])
+	io.ReadFull(r, chainKey[:])
+	return rootKey, chainKey
+}
+
+// KdfCK derives the next chain key and message key from the current chain key using HMAC.
+func (c DefaultCrypto) KdfCK(ck [32]byte) (chainKey, msgKey [32]byte) {
+	chainKey = hmacSum(ck, []byte{0x02})
+	msgKey = hmacSum(ck, []byte{0x01})
+	return chainKey, msgKey
+}
+
+func hmacSum(key [32]byte, data []byte) [32]byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write(data)
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// Encrypt encrypts plaintext with AES-256-GCM keyed by mk, binding ad via the AEAD's additional data.
+func (c DefaultCrypto) Encrypt(mk [32]byte, plaintext, ad []byte) []byte {
+	gcm := c.aead(mk)
+	nonce := make([]byte, gcm.NonceSize())
+	io.ReadFull(rand.Reader, nonce)
+	return gcm.Seal(nonce, nonce, plaintext, ad)
+}
+
+// Decrypt decrypts a ciphertext produced by Encrypt.
+func (c DefaultCrypto) Decrypt(mk [32]byte, ciphertext, ad []byte) ([]byte, error) {
+	gcm := c.aead(mk)
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ct := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ct, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %s", err)
+	}
+	return plaintext, nil
+}
+
+// EncryptHeader encrypts header with AES-256-GCM keyed by hk and no associated data, as per the HE spec.
+func (c DefaultCrypto) EncryptHeader(hk [32]byte, header []byte) []byte {
+	return c.Encrypt(hk, header, nil)
+}
+
+// DecryptHeader decrypts an encrypted header produced by EncryptHeader.
+func (c DefaultCrypto) DecryptHeader(hk [32]byte, encHeader []byte) ([]byte, error) {
+	return c.Decrypt(hk, encHeader, nil)
+}
+
+func (c DefaultCrypto) aead(key [32]byte) cipher.AEAD {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(fmt.Sprintf("failed to create aes cipher: %s", err))
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create gcm: %s", err))
+	}
+	return gcm
+}
@@ -0,0 +1,7 @@
+package doubleratchet
+
+// DHPair is a Diffie-Hellman key pair.
+type DHPair interface {
+	PrivateKey() [32]byte
+	PublicKey() [32]byte
+}
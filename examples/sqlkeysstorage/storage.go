@@ -0,0 +1,114 @@
+// Package sqlkeysstorage is an example doubleratchet.KeysStorage backed by a SQL database,
+// for applications that need skipped message keys to survive a process restart. The same
+// shape of queries works against a BoltDB-backed implementation, keyed by
+// session_id+pub_key+n instead of table columns.
+package sqlkeysstorage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Storage is a doubleratchet.KeysStorage backed by a SQL table created with:
+//
+//	CREATE TABLE skipped_keys (
+//		session_id TEXT NOT NULL,
+//		pub_key    BLOB NOT NULL,
+//		n          INTEGER NOT NULL,
+//		mk         BLOB NOT NULL,
+//		PRIMARY KEY (session_id, pub_key, n)
+//	);
+type Storage struct {
+	db *sql.DB
+}
+
+// New returns a Storage backed by db, which must already have the skipped_keys table.
+func New(db *sql.DB) *Storage {
+	return &Storage{db: db}
+}
+
+func (s *Storage) Get(sessionID string, pubKey [32]byte, n uint) (mk [32]byte, ok bool, err error) {
+	var raw []byte
+	err = s.db.QueryRow(
+		`SELECT mk FROM skipped_keys WHERE session_id = ? AND pub_key = ? AND n = ?`,
+		sessionID, pubKey[:], n,
+	).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return mk, false, nil
+	}
+	if err != nil {
+		return mk, false, fmt.Errorf("failed to query skipped key: %s", err)
+	}
+	copy(mk[:], raw)
+	return mk, true, nil
+}
+
+func (s *Storage) Put(sessionID string, pubKey [32]byte, n uint, mk [32]byte) error {
+	_, err := s.db.Exec(
+		`INSERT INTO skipped_keys (session_id, pub_key, n, mk) VALUES (?, ?, ?, ?)`,
+		sessionID, pubKey[:], n, mk[:],
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert skipped key: %s", err)
+	}
+	return nil
+}
+
+func (s *Storage) DeleteMk(sessionID string, pubKey [32]byte, n uint) error {
+	_, err := s.db.Exec(
+		`DELETE FROM skipped_keys WHERE session_id = ? AND pub_key = ? AND n = ?`,
+		sessionID, pubKey[:], n,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete skipped key: %s", err)
+	}
+	return nil
+}
+
+func (s *Storage) DeletePk(sessionID string, pubKey [32]byte) error {
+	_, err := s.db.Exec(
+		`DELETE FROM skipped_keys WHERE session_id = ? AND pub_key = ?`,
+		sessionID, pubKey[:],
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete skipped keys: %s", err)
+	}
+	return nil
+}
+
+func (s *Storage) Count(sessionID string, pubKey [32]byte) (uint, error) {
+	var count uint
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM skipped_keys WHERE session_id = ? AND pub_key = ?`,
+		sessionID, pubKey[:],
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count skipped keys: %s", err)
+	}
+	return count, nil
+}
+
+func (s *Storage) All(sessionID string) (map[[32]byte]map[uint][32]byte, error) {
+	rows, err := s.db.Query(`SELECT pub_key, n, mk FROM skipped_keys WHERE session_id = ?`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query skipped keys: %s", err)
+	}
+	defer rows.Close()
+
+	all := make(map[[32]byte]map[uint][32]byte)
+	for rows.Next() {
+		var pubKeyRaw, mkRaw []byte
+		var n uint
+		if err := rows.Scan(&pubKeyRaw, &n, &mkRaw); err != nil {
+			return nil, fmt.Errorf("failed to scan skipped key: %s", err)
+		}
+		var pubKey, mk [32]byte
+		copy(pubKey[:], pubKeyRaw)
+		copy(mk[:], mkRaw)
+		if all[pubKey] == nil {
+			all[pubKey] = make(map[uint][32]byte)
+		}
+		all[pubKey][n] = mk
+	}
+	return all, rows.Err()
+}
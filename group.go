@@ -0,0 +1,210 @@
+package doubleratchet
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// SenderKeyID identifies a single member's sending chain within a group.
+type SenderKeyID string
+
+// GroupState is a member's view of a group session built on shared sender keys: every member
+// ratchets its own sending chain forward with Crypto.KdfCK, the same symmetric-ratchet primitive
+// the pairwise State uses, and every other member keeps one receiving chain per sender instead of
+// running a full DH ratchet per pair.
+type GroupState interface {
+	// DistributionMessage returns the message this member should send (e.g. over a pairwise
+	// Double Ratchet session with each other member) to bootstrap a new or rejoining member
+	// onto this member's current sending chain.
+	DistributionMessage() GroupDistributionMessage
+
+	// ProcessDistribution registers or replaces the chain of the sender named in msg.
+	ProcessDistribution(msg GroupDistributionMessage) error
+
+	// Encrypt performs a symmetric-key ratchet step on this member's own sending chain, then
+	// encrypts plaintext with the resulting message key.
+	Encrypt(plaintext []byte, ad AssociatedData) GroupMessage
+
+	// Decrypt decrypts a message from a sender whose chain was previously registered with
+	// ProcessDistribution, skipping and storing any intervening message keys as needed.
+	Decrypt(msg GroupMessage, ad AssociatedData) ([]byte, error)
+
+	// Rotate replaces this member's sending chain with a freshly generated one and returns the
+	// distribution message the remaining members need, e.g. after a member leaves the group.
+	Rotate() GroupDistributionMessage
+}
+
+// GroupDistributionMessage bootstraps a member onto a sender's current sending chain. It's
+// typically delivered to each recipient over their own pairwise Double Ratchet session. This
+// package doesn't manage long-term identity keys: NewGroup never sets a signing key, so the
+// SigningPubKey in a DistributionMessage is always zero, and this package neither signs nor
+// verifies distribution messages.
+type GroupDistributionMessage struct {
+	SenderKeyID   SenderKeyID
+	ChainKey      [32]byte
+	N             uint
+	SigningPubKey [32]byte
+}
+
+// GroupMessage is what a member sends to the group after the encryption step.
+type GroupMessage struct {
+	SenderKeyID SenderKeyID
+	N           uint
+	Ciphertext  []byte
+}
+
+// groupReceivingChain is the state kept for one other member's sending chain.
+type groupReceivingChain struct {
+	ck [32]byte
+	n  uint
+}
+
+// Operations on this object are NOT THREAD-SAFE, make sure they're done in sequence.
+type groupState struct {
+	memberID SenderKeyID
+
+	crypto      Crypto
+	keysStorage KeysStorage
+	maxSkip     uint
+
+	signingPubKey [32]byte
+	sendingCK     [32]byte
+	sendingN      uint
+
+	receiving map[SenderKeyID]*groupReceivingChain
+}
+
+// NewGroup creates a member's group state under memberID, which must be unique within the group.
+// opts configures the same Crypto, MaxSkip and KeysStorage as New; options specific to the
+// pairwise DH ratchet (e.g. WithRemoteKey) don't apply to a group and are ignored.
+func NewGroup(memberID string, opts ...Option) GroupState {
+	cfg := &state{
+		MaxSkip:     1000,
+		Crypto:      DefaultCrypto{},
+		KeysStorage: newMemoryKeysStorage(),
+	}
+	// A throwaway DH pair, so pairwise-only options that compute a DH output (e.g. WithRemoteKey)
+	// can run against cfg without effect on the group.
+	if dh, err := cfg.Crypto.GenerateDH(); err == nil {
+		cfg.DHs = dh
+	}
+	for i := range opts {
+		opts[i](cfg)
+	}
+
+	g := &groupState{
+		memberID:    SenderKeyID(memberID),
+		crypto:      cfg.Crypto,
+		keysStorage: cfg.KeysStorage,
+		maxSkip:     cfg.MaxSkip,
+		receiving:   make(map[SenderKeyID]*groupReceivingChain),
+	}
+	g.sendingCK = randomChainKey()
+	return g
+}
+
+// randomChainKey generates a fresh, random chain key to seed or rotate a sending chain.
+func randomChainKey() [32]byte {
+	var ck [32]byte
+	if _, err := rand.Read(ck[:]); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %s", err))
+	}
+	return ck
+}
+
+// senderKeyIDToPubKey maps a SenderKeyID onto the [32]byte public-key space KeysStorage indexes
+// skipped message keys by, so group chains can reuse the same storage as pairwise sessions.
+func senderKeyIDToPubKey(id SenderKeyID) [32]byte {
+	return sha256.Sum256([]byte(id))
+}
+
+func (g *groupState) DistributionMessage() GroupDistributionMessage {
+	return GroupDistributionMessage{
+		SenderKeyID:   g.memberID,
+		ChainKey:      g.sendingCK,
+		N:             g.sendingN,
+		SigningPubKey: g.signingPubKey,
+	}
+}
+
+func (g *groupState) ProcessDistribution(msg GroupDistributionMessage) error {
+	if msg.SenderKeyID == g.memberID {
+		return fmt.Errorf("can't process a distribution message from ourselves")
+	}
+	if err := g.keysStorage.DeletePk(string(g.memberID), senderKeyIDToPubKey(msg.SenderKeyID)); err != nil {
+		return fmt.Errorf("failed to clear previously skipped keys: %s", err)
+	}
+	g.receiving[msg.SenderKeyID] = &groupReceivingChain{ck: msg.ChainKey, n: msg.N}
+	return nil
+}
+
+func (g *groupState) Encrypt(plaintext []byte, ad AssociatedData) GroupMessage {
+	var mk [32]byte
+	g.sendingCK, mk = g.crypto.KdfCK(g.sendingCK)
+	n := g.sendingN
+	g.sendingN++
+	ciphertext := g.crypto.Encrypt(mk, plaintext, groupAD(g.memberID, n, ad))
+	return GroupMessage{SenderKeyID: g.memberID, N: n, Ciphertext: ciphertext}
+}
+
+func (g *groupState) Decrypt(msg GroupMessage, ad AssociatedData) ([]byte, error) {
+	rc, ok := g.receiving[msg.SenderKeyID]
+	if !ok {
+		return nil, fmt.Errorf("no chain registered for sender %q, call ProcessDistribution first", msg.SenderKeyID)
+	}
+	pubKey := senderKeyIDToPubKey(msg.SenderKeyID)
+
+	if mk, ok, err := g.keysStorage.Get(string(g.memberID), pubKey, msg.N); err != nil {
+		return nil, fmt.Errorf("can't get skipped message key: %s", err)
+	} else if ok {
+		plaintext, err := g.crypto.Decrypt(mk, msg.Ciphertext, groupAD(msg.SenderKeyID, msg.N, ad))
+		if err != nil {
+			return nil, fmt.Errorf("can't decrypt message: %s", err)
+		}
+		if err := g.keysStorage.DeleteMk(string(g.memberID), pubKey, msg.N); err != nil {
+			return nil, fmt.Errorf("can't delete skipped message key: %s", err)
+		}
+		return plaintext, nil
+	}
+
+	if msg.N < rc.n {
+		return nil, fmt.Errorf("message key for n=%d was already used", msg.N)
+	}
+	if msg.N-rc.n > g.maxSkip {
+		return nil, fmt.Errorf("too many messages: %d", msg.N-rc.n)
+	}
+	for rc.n < msg.N {
+		var mk [32]byte
+		rc.ck, mk = g.crypto.KdfCK(rc.ck)
+		if err := g.keysStorage.Put(string(g.memberID), pubKey, rc.n, mk); err != nil {
+			return nil, fmt.Errorf("can't store skipped message key: %s", err)
+		}
+		rc.n++
+	}
+
+	var mk [32]byte
+	rc.ck, mk = g.crypto.KdfCK(rc.ck)
+	rc.n++
+	plaintext, err := g.crypto.Decrypt(mk, msg.Ciphertext, groupAD(msg.SenderKeyID, msg.N, ad))
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt message: %s", err)
+	}
+	return plaintext, nil
+}
+
+func (g *groupState) Rotate() GroupDistributionMessage {
+	g.sendingCK = randomChainKey()
+	g.sendingN = 0
+	return g.DistributionMessage()
+}
+
+// groupAD binds the sender and message number into the AEAD associated data, mirroring how
+// MessageHeader.EncodeWithAD binds the pairwise ratchet's header.
+func groupAD(senderKeyID SenderKeyID, n uint, ad AssociatedData) []byte {
+	buf := make([]byte, 0, len(ad)+len(senderKeyID)+8)
+	buf = append(buf, ad...)
+	buf = append(buf, senderKeyID...)
+	buf = append(buf, encodeUint(n)...)
+	return buf
+}
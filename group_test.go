@@ -0,0 +1,80 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGroupRoundTrip(t *testing.T) {
+	alice := NewGroup("alice")
+	bob := NewGroup("bob")
+
+	if err := bob.ProcessDistribution(alice.DistributionMessage()); err != nil {
+		t.Fatalf("bob failed to process alice's distribution: %s", err)
+	}
+	if err := alice.ProcessDistribution(bob.DistributionMessage()); err != nil {
+		t.Fatalf("alice failed to process bob's distribution: %s", err)
+	}
+
+	ad := AssociatedData("group-ad")
+	msg := alice.Encrypt([]byte("hello group"), ad)
+	pt, err := bob.Decrypt(msg, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(pt, []byte("hello group")) {
+		t.Fatalf("bob got %q, want %q", pt, "hello group")
+	}
+}
+
+func TestGroupOutOfOrderDelivery(t *testing.T) {
+	alice := NewGroup("alice")
+	bob := NewGroup("bob")
+	if err := bob.ProcessDistribution(alice.DistributionMessage()); err != nil {
+		t.Fatalf("bob failed to process alice's distribution: %s", err)
+	}
+
+	ad := AssociatedData("group-ad")
+	m1 := alice.Encrypt([]byte("first"), ad)
+	m2 := alice.Encrypt([]byte("second"), ad)
+
+	// Bob receives m2 before m1: decrypting it must skip and store the message key for m1.
+	pt2, err := bob.Decrypt(m2, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt m2: %s", err)
+	}
+	if !bytes.Equal(pt2, []byte("second")) {
+		t.Fatalf("bob got %q, want %q", pt2, "second")
+	}
+
+	pt1, err := bob.Decrypt(m1, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt skipped m1: %s", err)
+	}
+	if !bytes.Equal(pt1, []byte("first")) {
+		t.Fatalf("bob got %q, want %q", pt1, "first")
+	}
+}
+
+func TestGroupRotate(t *testing.T) {
+	alice := NewGroup("alice")
+	bob := NewGroup("bob")
+	if err := bob.ProcessDistribution(alice.DistributionMessage()); err != nil {
+		t.Fatalf("bob failed to process alice's distribution: %s", err)
+	}
+
+	dist := alice.Rotate()
+	if err := bob.ProcessDistribution(dist); err != nil {
+		t.Fatalf("bob failed to process rotated distribution: %s", err)
+	}
+
+	ad := AssociatedData("group-ad")
+	msg := alice.Encrypt([]byte("after rotate"), ad)
+	pt, err := bob.Decrypt(msg, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt after rotate: %s", err)
+	}
+	if !bytes.Equal(pt, []byte("after rotate")) {
+		t.Fatalf("bob got %q, want %q", pt, "after rotate")
+	}
+}
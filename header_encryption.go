@@ -0,0 +1,31 @@
+package doubleratchet
+
+// WithHeaderEncryption enables the Header Encryption (HE) variant of the Double Ratchet
+// Algorithm described in https://signal.org/docs/specifications/doubleratchet/#header-encryption.
+//
+// sharedHKA and sharedNHKB must be agreed upon out of band, alongside the sharedKey passed to
+// New, before the session starts: sharedHKA is Alice's (the initiator's) first sending header
+// key, and sharedNHKB is Bob's (the responder's) first next-header-key. Apply this option after
+// WithRemoteKey, since it uses DHr to tell which side of the session it's configuring.
+func WithHeaderEncryption(sharedHKA, sharedNHKB [32]byte) Option {
+	return func(s *state) error {
+		s.headerEncryption = true
+		if s.DHr == [32]byte{} {
+			// We're Bob: we have no current header keys of our own yet, only the key Alice
+			// will use to encrypt her first header (our fallback NHKr, since our HKr is still
+			// unset) and the key our own first selfRatchet will rotate into HKs.
+			s.NHKr = sharedHKA
+			s.NHKs = sharedNHKB
+		} else {
+			// We're Alice: WithRemoteKey already set DHr, so we already know our sending
+			// header key, and the fallback we'll use to detect Bob's first ratchet. We also need
+			// our own NHKs already, derived the same way selfRatchet derives one: our first reply
+			// to Bob rotates HKs from NHKs, and by then it's too late to go back and derive it
+			// from this handshake's DH output.
+			s.HKs = sharedHKA
+			s.NHKr = sharedNHKB
+			_, s.NHKs = s.Crypto.KdfRK(s.RK, s.Crypto.DH(s.DHs, s.DHr))
+		}
+		return nil
+	}
+}
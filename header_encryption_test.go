@@ -0,0 +1,205 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// sharedHeaderKeys returns a fixed sharedHKA/sharedNHKB pair for tests, standing in for the
+// out-of-band agreement WithHeaderEncryption's doc comment describes.
+func sharedHeaderKeys() (sharedHKA, sharedNHKB [32]byte) {
+	sharedHKA = [32]byte{1}
+	sharedNHKB = [32]byte{2}
+	return sharedHKA, sharedNHKB
+}
+
+func TestHeaderEncryptionRoundTrip(t *testing.T) {
+	sharedKey := [32]byte{9}
+	sharedHKA, sharedNHKB := sharedHeaderKeys()
+
+	bob, err := New(sharedKey, WithHeaderEncryption(sharedHKA, sharedNHKB))
+	if err != nil {
+		t.Fatalf("failed to create bob: %s", err)
+	}
+	bobPub := bob.(*state).DHs.PublicKey()
+
+	alice, err := New(sharedKey, WithRemoteKey(bobPub), WithHeaderEncryption(sharedHKA, sharedNHKB))
+	if err != nil {
+		t.Fatalf("failed to create alice: %s", err)
+	}
+
+	ad := AssociatedData("ad")
+
+	// Alice's first message: Bob must decrypt it via resolveHeader's NHKr fallback and perform
+	// his first dhRatchet.
+	m1, err := alice.RatchetEncrypt([]byte("hello bob"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt: %s", err)
+	}
+	pt1, err := bob.RatchetDecrypt(m1, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(pt1, []byte("hello bob")) {
+		t.Fatalf("bob got %q, want %q", pt1, "hello bob")
+	}
+
+	// Bob replies, ratcheting onto a new DH key of his own; Alice must decrypt it via her own
+	// dhRatchet.
+	m2, err := bob.RatchetEncrypt([]byte("hello alice"), ad)
+	if err != nil {
+		t.Fatalf("bob failed to encrypt: %s", err)
+	}
+	pt2, err := alice.RatchetDecrypt(m2, ad)
+	if err != nil {
+		t.Fatalf("alice failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(pt2, []byte("hello alice")) {
+		t.Fatalf("alice got %q, want %q", pt2, "hello alice")
+	}
+
+	// One more round trip in each direction, to make sure the ratcheted chains keep working.
+	m3, err := alice.RatchetEncrypt([]byte("how are you"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt: %s", err)
+	}
+	pt3, err := bob.RatchetDecrypt(m3, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(pt3, []byte("how are you")) {
+		t.Fatalf("bob got %q, want %q", pt3, "how are you")
+	}
+}
+
+// TestHeaderEncryptionSkippedMessageSurvivesMultipleRatchets checks that a message delayed by
+// more than one ratchet step is still recoverable: resolveHeader must fall back to every header
+// key ever remembered in headerKeysSeen, not just the current HKr/NHKr pair, once the ratchet has
+// moved on further than that.
+func TestHeaderEncryptionSkippedMessageSurvivesMultipleRatchets(t *testing.T) {
+	sharedKey := [32]byte{9}
+	sharedHKA, sharedNHKB := sharedHeaderKeys()
+
+	bob, err := New(sharedKey, WithHeaderEncryption(sharedHKA, sharedNHKB))
+	if err != nil {
+		t.Fatalf("failed to create bob: %s", err)
+	}
+	bobPub := bob.(*state).DHs.PublicKey()
+
+	alice, err := New(sharedKey, WithRemoteKey(bobPub), WithHeaderEncryption(sharedHKA, sharedNHKB))
+	if err != nil {
+		t.Fatalf("failed to create alice: %s", err)
+	}
+
+	ad := AssociatedData("ad")
+
+	// One round trip each way, so both sides have ratcheted once and are past their initial keys.
+	m1, err := alice.RatchetEncrypt([]byte("hello bob"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt m1: %s", err)
+	}
+	if _, err := bob.RatchetDecrypt(m1, ad); err != nil {
+		t.Fatalf("bob failed to decrypt m1: %s", err)
+	}
+	m2, err := bob.RatchetEncrypt([]byte("hello alice"), ad)
+	if err != nil {
+		t.Fatalf("bob failed to encrypt m2: %s", err)
+	}
+	if _, err := alice.RatchetDecrypt(m2, ad); err != nil {
+		t.Fatalf("alice failed to decrypt m2: %s", err)
+	}
+
+	// Alice sends two messages on a new ratchet generation; Bob only gets the newest one right away.
+	mSkipped, err := alice.RatchetEncrypt([]byte("skipped"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt mSkipped: %s", err)
+	}
+	mNewest, err := alice.RatchetEncrypt([]byte("newest"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt mNewest: %s", err)
+	}
+	ptNewest, err := bob.RatchetDecrypt(mNewest, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt mNewest: %s", err)
+	}
+	if !bytes.Equal(ptNewest, []byte("newest")) {
+		t.Fatalf("bob got %q, want %q", ptNewest, "newest")
+	}
+
+	// Both sides ratchet once more in each direction, so bob's HKr/NHKr move past the header key
+	// mSkipped was encrypted under.
+	mReply, err := bob.RatchetEncrypt([]byte("got it"), ad)
+	if err != nil {
+		t.Fatalf("bob failed to encrypt mReply: %s", err)
+	}
+	if _, err := alice.RatchetDecrypt(mReply, ad); err != nil {
+		t.Fatalf("alice failed to decrypt mReply: %s", err)
+	}
+	mFollowup, err := alice.RatchetEncrypt([]byte("one more"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt mFollowup: %s", err)
+	}
+	if _, err := bob.RatchetDecrypt(mFollowup, ad); err != nil {
+		t.Fatalf("bob failed to decrypt mFollowup: %s", err)
+	}
+
+	// mSkipped arrives late, more than one ratchet generation behind bob's current HKr/NHKr.
+	ptSkipped, err := bob.RatchetDecrypt(mSkipped, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt the delayed mSkipped: %s", err)
+	}
+	if !bytes.Equal(ptSkipped, []byte("skipped")) {
+		t.Fatalf("bob got %q, want %q", ptSkipped, "skipped")
+	}
+}
+
+// TestHeaderEncryptionSkippedMessageSurvivesSnapshotRoundTrip checks that a skipped message key
+// left outstanding in header encryption mode is still recoverable after a Snapshot/FromSnapshot
+// round trip, provided the caller passes back the same KeysStorage: StateSnapshot must carry
+// headerKeysSeen too, or trySkippedMessageKeys has nothing to trial-decrypt against post-restore.
+func TestHeaderEncryptionSkippedMessageSurvivesSnapshotRoundTrip(t *testing.T) {
+	sharedKey := [32]byte{9}
+	sharedHKA, sharedNHKB := sharedHeaderKeys()
+
+	bob, err := New(sharedKey, WithSessionID("alice-bob"), WithHeaderEncryption(sharedHKA, sharedNHKB))
+	if err != nil {
+		t.Fatalf("failed to create bob: %s", err)
+	}
+	bobPub := bob.(*state).DHs.PublicKey()
+
+	alice, err := New(sharedKey, WithRemoteKey(bobPub), WithHeaderEncryption(sharedHKA, sharedNHKB))
+	if err != nil {
+		t.Fatalf("failed to create alice: %s", err)
+	}
+
+	ad := AssociatedData("ad")
+
+	mSkipped, err := alice.RatchetEncrypt([]byte("skipped"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt mSkipped: %s", err)
+	}
+	mNewest, err := alice.RatchetEncrypt([]byte("newest"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt mNewest: %s", err)
+	}
+	if _, err := bob.RatchetDecrypt(mNewest, ad); err != nil {
+		t.Fatalf("bob failed to decrypt mNewest: %s", err)
+	}
+
+	// Snapshot and restore bob with one skipped message still pending, reusing his own
+	// KeysStorage as the caller is required to.
+	keysStorage := bob.(*state).KeysStorage
+	snap := bob.Snapshot()
+	restoredBob, err := FromSnapshot(snap, keysStorage)
+	if err != nil {
+		t.Fatalf("failed to restore bob from snapshot: %s", err)
+	}
+
+	ptSkipped, err := restoredBob.RatchetDecrypt(mSkipped, ad)
+	if err != nil {
+		t.Fatalf("restored bob failed to decrypt the skipped message: %s", err)
+	}
+	if !bytes.Equal(ptSkipped, []byte("skipped")) {
+		t.Fatalf("restored bob got %q, want %q", ptSkipped, "skipped")
+	}
+}
@@ -0,0 +1,25 @@
+package doubleratchet
+
+// KeysStorage stores message keys skipped by a receiving chain, so a message that arrives late
+// or out of order can still be decrypted when it does. Sessions are identified by sessionID so a
+// single storage instance (e.g. backed by a shared database) can serve many concurrent sessions.
+type KeysStorage interface {
+	// Get returns the message key stored for (pubKey, n) under sessionID, if any.
+	Get(sessionID string, pubKey [32]byte, n uint) (mk [32]byte, ok bool, err error)
+
+	// Put stores the message key mk for (pubKey, n) under sessionID.
+	Put(sessionID string, pubKey [32]byte, n uint, mk [32]byte) error
+
+	// DeleteMk removes the message key stored for (pubKey, n) under sessionID, if any.
+	DeleteMk(sessionID string, pubKey [32]byte, n uint) error
+
+	// DeletePk removes every message key stored under (sessionID, pubKey).
+	DeletePk(sessionID string, pubKey [32]byte) error
+
+	// Count returns the number of message keys currently stored under (sessionID, pubKey).
+	Count(sessionID string, pubKey [32]byte) (uint, error)
+
+	// All returns every message key stored for sessionID, keyed by the ratchet/header public
+	// key it was skipped under.
+	All(sessionID string) (map[[32]byte]map[uint][32]byte, error)
+}
@@ -0,0 +1,63 @@
+package doubleratchet
+
+import "sync"
+
+// memoryKeysStorage is the default KeysStorage: an in-process map that's lost on restart. It's
+// fine for short-lived sessions; use a KeysStorage backed by BoltDB or SQL (see the
+// examples/sqlkeysstorage package) for sessions that must survive a process restart.
+type memoryKeysStorage struct {
+	mu   sync.Mutex
+	keys map[string]map[[32]byte]map[uint][32]byte
+}
+
+func newMemoryKeysStorage() *memoryKeysStorage {
+	return &memoryKeysStorage{
+		keys: make(map[string]map[[32]byte]map[uint][32]byte),
+	}
+}
+
+func (s *memoryKeysStorage) Get(sessionID string, pubKey [32]byte, n uint) ([32]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mk, ok := s.keys[sessionID][pubKey][n]
+	return mk, ok, nil
+}
+
+func (s *memoryKeysStorage) Put(sessionID string, pubKey [32]byte, n uint, mk [32]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys[sessionID] == nil {
+		s.keys[sessionID] = make(map[[32]byte]map[uint][32]byte)
+	}
+	if s.keys[sessionID][pubKey] == nil {
+		s.keys[sessionID][pubKey] = make(map[uint][32]byte)
+	}
+	s.keys[sessionID][pubKey][n] = mk
+	return nil
+}
+
+func (s *memoryKeysStorage) DeleteMk(sessionID string, pubKey [32]byte, n uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys[sessionID][pubKey], n)
+	return nil
+}
+
+func (s *memoryKeysStorage) DeletePk(sessionID string, pubKey [32]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys[sessionID], pubKey)
+	return nil
+}
+
+func (s *memoryKeysStorage) Count(sessionID string, pubKey [32]byte) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint(len(s.keys[sessionID][pubKey])), nil
+}
+
+func (s *memoryKeysStorage) All(sessionID string) (map[[32]byte]map[uint][32]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[sessionID], nil
+}
@@ -0,0 +1,79 @@
+package doubleratchet
+
+import "fmt"
+
+// MessageHeader that is sent alongside the encrypted message.
+type MessageHeader struct {
+	// DH is the sender's current ratchet public key.
+	DH [32]byte
+
+	// N is the message number within the sending chain.
+	N uint
+
+	// PN is the length of the previous sending chain.
+	PN uint
+}
+
+// EncodeWithAD concatenates the header with the associated data, so that both
+// are covered by the AEAD authentication of the ciphertext.
+func (h MessageHeader) EncodeWithAD(ad AssociatedData) []byte {
+	buf := make([]byte, 0, len(ad)+len(h.DH)+16)
+	buf = append(buf, ad...)
+	buf = append(buf, h.DH[:]...)
+	buf = append(buf, encodeUint(h.N)...)
+	buf = append(buf, encodeUint(h.PN)...)
+	return buf
+}
+
+// encodeUint encodes n as a fixed-width, big-endian 8-byte value.
+func encodeUint(n uint) []byte {
+	b := make([]byte, 8)
+	for i := 7; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	return b
+}
+
+func decodeUint(b []byte) uint {
+	var n uint
+	for _, v := range b {
+		n = n<<8 | uint(v)
+	}
+	return n
+}
+
+// Encode serializes the header on its own, so it can be encrypted in header encryption mode.
+func (h MessageHeader) Encode() []byte {
+	buf := make([]byte, 0, len(h.DH)+16)
+	buf = append(buf, h.DH[:]...)
+	buf = append(buf, encodeUint(h.N)...)
+	buf = append(buf, encodeUint(h.PN)...)
+	return buf
+}
+
+// decodeMessageHeader parses a header serialized by MessageHeader.Encode.
+func decodeMessageHeader(b []byte) (MessageHeader, error) {
+	if len(b) != 48 {
+		return MessageHeader{}, fmt.Errorf("invalid header length: %d", len(b))
+	}
+	var h MessageHeader
+	copy(h.DH[:], b[:32])
+	h.N = decodeUint(b[32:40])
+	h.PN = decodeUint(b[40:48])
+	return h, nil
+}
+
+// Message is what a party sends to the other after the encryption step.
+// Exactly one of Header or EncHeader is populated, depending on whether the
+// session was created with WithHeaderEncryption.
+type Message struct {
+	// Header is the message header in the clear. Unused when header encryption is enabled.
+	Header MessageHeader
+
+	// EncHeader is the message header encrypted with the current header key.
+	// Populated instead of Header when header encryption is enabled.
+	EncHeader []byte
+
+	Ciphertext []byte
+}
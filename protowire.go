@@ -0,0 +1,80 @@
+package doubleratchet
+
+import "fmt"
+
+// This file hand-encodes the small, flat, non-repeating messages declared in message.proto using
+// the plain protobuf wire format, so the package doesn't need to depend on a protobuf runtime.
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|0)
+	return appendVarint(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, v []byte) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|2)
+	buf = appendVarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// parseProtoFields parses a field number to either a uint64 (varint wire type) or a []byte
+// (length-delimited wire type), which is all message.proto's messages use.
+func parseProtoFields(b []byte) (map[int]interface{}, error) {
+	fields := make(map[int]interface{})
+	for len(b) > 0 {
+		tag, n, err := readVarint(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read field tag: %s", err)
+		}
+		b = b[n:]
+		field, wireType := int(tag>>3), tag&0x7
+
+		switch wireType {
+		case 0:
+			v, n, err := readVarint(b)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read field %d: %s", field, err)
+			}
+			b = b[n:]
+			fields[field] = v
+		case 2:
+			l, n, err := readVarint(b)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read length of field %d: %s", field, err)
+			}
+			b = b[n:]
+			if uint64(len(b)) < l {
+				return nil, fmt.Errorf("truncated field %d", field)
+			}
+			fields[field] = append([]byte(nil), b[:l]...)
+			b = b[l:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d for field %d", wireType, field)
+		}
+	}
+	return fields, nil
+}
+
+func readVarint(b []byte) (v uint64, n int, err error) {
+	for shift := uint(0); ; shift += 7 {
+		if n >= len(b) {
+			return 0, 0, fmt.Errorf("truncated varint")
+		}
+		c := b[n]
+		n++
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v, n, nil
+		}
+		if shift >= 63 {
+			return 0, 0, fmt.Errorf("varint overflow")
+		}
+	}
+}
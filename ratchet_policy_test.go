@@ -0,0 +1,43 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestRatchetPolicyForcedRatchet exercises a WithRatchetPolicy(2, 0) session where Alice sends
+// three messages in a row without ever hearing back from Bob: the third send crosses the
+// maxMessages threshold and must perform a self-initiated DH ratchet step that Bob, who has no
+// other way of learning about Alice's new key, can still follow.
+func TestRatchetPolicyForcedRatchet(t *testing.T) {
+	alice, bob := newTestPair(t, WithRatchetPolicy(2, 0))
+	ad := AssociatedData("ad")
+
+	messages := []string{"one", "two", "three"}
+	for i, text := range messages {
+		m, err := alice.RatchetEncrypt([]byte(text), ad)
+		if err != nil {
+			t.Fatalf("alice failed to encrypt message %d: %s", i, err)
+		}
+		pt, err := bob.RatchetDecrypt(m, ad)
+		if err != nil {
+			t.Fatalf("bob failed to decrypt message %d (%q): %s", i, text, err)
+		}
+		if !bytes.Equal(pt, []byte(text)) {
+			t.Fatalf("message %d: bob got %q, want %q", i, pt, text)
+		}
+	}
+
+	// Bob replying afterwards must still work, confirming RK/CKr/CKs didn't diverge.
+	reply, err := bob.RatchetEncrypt([]byte("got it"), ad)
+	if err != nil {
+		t.Fatalf("bob failed to encrypt reply: %s", err)
+	}
+	pt, err := alice.RatchetDecrypt(reply, ad)
+	if err != nil {
+		t.Fatalf("alice failed to decrypt reply: %s", err)
+	}
+	if !bytes.Equal(pt, []byte("got it")) {
+		t.Fatalf("alice got %q, want %q", pt, "got it")
+	}
+}
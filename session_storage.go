@@ -0,0 +1,107 @@
+package doubleratchet
+
+import (
+	"fmt"
+	"time"
+)
+
+// SessionStorage lets an application persist a session across process restarts without reaching
+// into doubleratchet's unexported state, by round-tripping through the exported StateSnapshot.
+type SessionStorage interface {
+	// Save persists the state of the session identified by id.
+	Save(id string, snap StateSnapshot) error
+
+	// Load restores the session identified by id, reporting ok == false if none was saved.
+	Load(id string) (snap StateSnapshot, ok bool, err error)
+}
+
+// StateSnapshot is an exported, serializable view of a session's state, produced by
+// State.Snapshot and consumed by FromSnapshot.
+type StateSnapshot struct {
+	ID string
+
+	RK, DHr               [32]byte
+	DHsPrivate, DHsPublic [32]byte
+	CKs, CKr              [32]byte
+	Ns, Nr, PN            uint
+	MaxSkip               uint
+
+	HeaderEncryption     bool
+	HKs, HKr, NHKs, NHKr [32]byte
+	HeaderKeysSeen       [][32]byte
+
+	RatchetMaxMessages    uint
+	RatchetMaxAge         time.Duration
+	LastRatchetAt         time.Time
+	SendCountSinceRatchet uint
+	SendRatchetRequired   bool
+}
+
+// Snapshot returns an exported, serializable view of s's state, suitable for handing to a
+// SessionStorage implementation.
+func (s *state) Snapshot() StateSnapshot {
+	return StateSnapshot{
+		ID:               s.ID,
+		RK:               s.RK,
+		DHr:              s.DHr,
+		DHsPrivate:       s.DHs.PrivateKey(),
+		DHsPublic:        s.DHs.PublicKey(),
+		CKs:              s.CKs,
+		CKr:              s.CKr,
+		Ns:               s.Ns,
+		Nr:               s.Nr,
+		PN:               s.PN,
+		MaxSkip:          s.MaxSkip,
+		HeaderEncryption: s.headerEncryption,
+		HKs:              s.HKs,
+		HKr:              s.HKr,
+		NHKs:             s.NHKs,
+		NHKr:             s.NHKr,
+		HeaderKeysSeen:   s.headerKeysSeen,
+
+		RatchetMaxMessages:    s.RatchetMaxMessages,
+		RatchetMaxAge:         s.RatchetMaxAge,
+		LastRatchetAt:         s.LastRatchetAt,
+		SendCountSinceRatchet: s.SendCountSinceRatchet,
+		SendRatchetRequired:   s.sendRatchetRequired,
+	}
+}
+
+// FromSnapshot restores a session previously captured with State.Snapshot, e.g. one loaded from
+// a SessionStorage. keysStorage is used to resolve any message keys skipped before the snapshot
+// was taken; pass the same one the original session used.
+func FromSnapshot(snap StateSnapshot, keysStorage KeysStorage) (State, error) {
+	dh, err := DefaultCrypto{}.LoadDH(snap.DHsPrivate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore dh pair: %s", err)
+	}
+
+	s := &state{
+		ID:               snap.ID,
+		RK:               snap.RK,
+		DHr:              snap.DHr,
+		DHs:              dh,
+		CKs:              snap.CKs,
+		CKr:              snap.CKr,
+		Ns:               snap.Ns,
+		Nr:               snap.Nr,
+		PN:               snap.PN,
+		MaxSkip:          snap.MaxSkip,
+		Crypto:           DefaultCrypto{},
+		Codec:            protoCodec{},
+		KeysStorage:      keysStorage,
+		headerEncryption: snap.HeaderEncryption,
+		HKs:              snap.HKs,
+		HKr:              snap.HKr,
+		NHKs:             snap.NHKs,
+		NHKr:             snap.NHKr,
+		headerKeysSeen:   snap.HeaderKeysSeen,
+
+		RatchetMaxMessages:    snap.RatchetMaxMessages,
+		RatchetMaxAge:         snap.RatchetMaxAge,
+		LastRatchetAt:         snap.LastRatchetAt,
+		SendCountSinceRatchet: snap.SendCountSinceRatchet,
+		sendRatchetRequired:   snap.SendRatchetRequired,
+	}
+	return s, nil
+}
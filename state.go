@@ -1,24 +1,39 @@
 package doubleratchet
 
 import (
-	"encoding/hex"
 	"fmt"
+	"time"
 )
 
 // State of the party involved in The Double Ratchet Algorithm.
 type State interface {
 	// RatchetEncrypt performs a symmetric-key ratchet step, then encrypts the message with
-	// the resulting message key.
-	RatchetEncrypt(plaintext []byte, ad AssociatedData) Message
+	// the resulting message key. If RatchetDecrypt left a sending-side DH ratchet step pending,
+	// or a ratchet policy set with WithRatchetPolicy is due, it first performs that step.
+	RatchetEncrypt(plaintext []byte, ad AssociatedData) (Message, error)
 
 	// RatchetDecrypt is called to decrypt messages.
 	RatchetDecrypt(m Message, ad AssociatedData) ([]byte, error)
+
+	// Snapshot returns an exported, serializable view of the session, suitable for handing to a
+	// SessionStorage so it survives a process restart.
+	Snapshot() StateSnapshot
+
+	// Encode serializes m using the session's Codec (see WithCodec), so it can be handed to the
+	// peer as a single blob instead of assembling Header/EncHeader and Ciphertext manually.
+	Encode(m Message) ([]byte, error)
+
+	// Decode parses a blob produced by Encode back into a Message.
+	Decode(b []byte) (Message, error)
 }
 
 // Operations on this object are NOT THREAD-SAFE, make sure they're done in sequence.
-// TODO: Store skipper separately.
-// TODO: Store state separately?
 type state struct {
+	// ID identifies this session to the KeysStorage and, if used, a SessionStorage. Multiple
+	// concurrent sessions can share a single KeysStorage/SessionStorage as long as their IDs
+	// are unique.
+	ID string
+
 	// 32-byte root key. Both parties MUST agree on this key before starting a ratchet session.
 	RK [32]byte
 
@@ -37,8 +52,9 @@ type state struct {
 	// Number of messages in previous sending chain.
 	PN uint
 
-	// Dictionary of skipped-over message keys, indexed by ratchet public key and message number.
-	MkSkipped map[string][32]byte
+	// KeysStorage holds skipped-over message keys, indexed by ratchet public key (or, in header
+	// encryption mode, header key) and message number.
+	KeysStorage KeysStorage
 
 	// MaxSkip should be set high enough to tolerate routine lost or delayed messages,
 	// but low enough that a malicious sender can't trigger excessive recipient computation.
@@ -46,21 +62,56 @@ type state struct {
 
 	// Cryptography functions for the Double Ratchet Algorithm to function.
 	Crypto Crypto
+
+	// Codec serializes Message to and from the wire, see WithCodec.
+	Codec Codec
+
+	// headerEncryption enables the HE variant of the algorithm, see WithHeaderEncryption.
+	headerEncryption bool
+
+	// Header keys for sending and receiving, used to encrypt/decrypt MessageHeader when
+	// headerEncryption is enabled.
+	HKs, HKr [32]byte
+
+	// Next header keys for sending and receiving: NHKr is rotated into HKr on the next dhRatchet,
+	// NHKs into HKs on the next selfRatchet.
+	NHKs, NHKr [32]byte
+
+	// headerKeysSeen remembers every distinct receiving header key a skipped message key was
+	// stored under, so trySkippedMessageKeys can find which one a later message used.
+	headerKeysSeen [][32]byte
+
+	// RatchetMaxMessages and RatchetMaxAge configure a self-initiated DH ratchet step on the
+	// sending chain, see WithRatchetPolicy. Zero disables the respective trigger.
+	RatchetMaxMessages    uint
+	RatchetMaxAge         time.Duration
+	LastRatchetAt         time.Time
+	SendCountSinceRatchet uint
+
+	// sendRatchetRequired reports that dhRatchet has just rotated DHr onto a new, confirmed-fresh
+	// peer key, so the next RatchetEncrypt must perform the matching sending-side ratchet step
+	// (generating a new DHs and rolling RK/CKs forward) before it can encrypt. This step is
+	// deliberately deferred to send time rather than performed eagerly inside dhRatchet: see
+	// selfRatchet's comment for why.
+	sendRatchetRequired bool
 }
 
 // New creates state with the shared key and public key of the other party initiating the session.
-// If this party initiates the session, pubKey must be nil.
+// If this party initiates the session, pubKey must be nil. Both parties MUST agree on sharedKey
+// before starting a ratchet session; see the x3dh subpackage for a ready-made way to derive one.
 func New(sharedKey [32]byte, opts ...Option) (State, error) {
 	if sharedKey == [32]byte{} {
 		return nil, fmt.Errorf("sharedKey must be non-zero")
 	}
 	s := &state{
-		RK:        sharedKey,
-		CKs:       sharedKey, // Populate CKs and CKr with sharedKey as per specification so that both
-		CKr:       sharedKey, // parties could both send and receive messages from the very beginning.
-		MkSkipped: make(map[string][32]byte),
-		MaxSkip:   1000,
-		Crypto:    DefaultCrypto{},
+		RK:            sharedKey,
+		CKs:           sharedKey, // Populate CKs and CKr with sharedKey as per specification so that both
+		CKr:           sharedKey, // parties could both send and receive messages from the very beginning.
+		KeysStorage:   newMemoryKeysStorage(),
+		MaxSkip:       1000,
+		Crypto:        DefaultCrypto{},
+		Codec:         protoCodec{},
+		LastRatchetAt: time.Now(),
 	}
 
 	var err error
@@ -90,6 +141,54 @@ func WithRemoteKey(dhRemotePubKey [32]byte) Option {
 	}
 }
 
+// WithOwnKeyPair seeds this party's own initial DH ratchet keypair from a private key generated
+// elsewhere, instead of letting New generate a fresh one. This is needed whenever some other
+// protocol has already committed the other party to this party's initial public key ahead of
+// time — e.g. the x3dh subpackage's InitiatorHandshake returns the initiator's ephemeral private
+// key for exactly this purpose, since ResponderHandshake feeds the matching public key into its
+// own WithRemoteKey call. Apply this option before WithRemoteKey, since WithRemoteKey's DH
+// computation depends on DHs already being set.
+func WithOwnKeyPair(privateKey [32]byte) Option {
+	return func(s *state) error {
+		dh, err := s.Crypto.LoadDH(privateKey)
+		if err != nil {
+			return fmt.Errorf("failed to load dh pair: %s", err)
+		}
+		s.DHs = dh
+		return nil
+	}
+}
+
+// WithSessionID sets the identifier this session is stored under in its KeysStorage and, if
+// used, SessionStorage. Sessions sharing a storage instance must use distinct IDs.
+func WithSessionID(id string) Option {
+	return func(s *state) error {
+		s.ID = id
+		return nil
+	}
+}
+
+// WithKeysStorage overrides the default in-memory storage of skipped message keys, e.g. with one
+// backed by a database so skipped keys survive a process restart.
+func WithKeysStorage(keysStorage KeysStorage) Option {
+	return func(s *state) error {
+		s.KeysStorage = keysStorage
+		return nil
+	}
+}
+
+// WithRatchetPolicy makes RatchetEncrypt perform a self-initiated DH ratchet step on the sending
+// chain once it has sent maxMessages messages since the last ratchet step, or once maxAge has
+// elapsed since the last one, whichever happens first. Passing 0 for either disables that
+// trigger; passing 0 for both leaves ratcheting entirely receive-driven, the default.
+func WithRatchetPolicy(maxMessages uint, maxAge time.Duration) Option {
+	return func(s *state) error {
+		s.RatchetMaxMessages = maxMessages
+		s.RatchetMaxAge = maxAge
+		return nil
+	}
+}
+
 // WithMaxSkip specifies the maximum number of skipped message in a single chain.
 func WithMaxSkip(maxSkip int) Option {
 	return func(s *state) error {
@@ -102,8 +201,15 @@ func WithMaxSkip(maxSkip int) Option {
 }
 
 // RatchetEncrypt performs a symmetric-key ratchet step, then encrypts the message with
-// the resulting message key.
-func (s *state) RatchetEncrypt(plaintext []byte, ad AssociatedData) Message {
+// the resulting message key. If dhRatchet left a sending-side ratchet step pending, or a ratchet
+// policy set with WithRatchetPolicy is due, it first performs that DH ratchet step.
+func (s *state) RatchetEncrypt(plaintext []byte, ad AssociatedData) (Message, error) {
+	if s.sendRatchetRequired || s.ratchetPolicyDue() {
+		if err := s.selfRatchet(); err != nil {
+			return Message{}, fmt.Errorf("failed to perform self-initiated ratchet step: %s", err)
+		}
+	}
+
 	var mk [32]byte
 	s.CKs, mk = s.Crypto.KdfCK(s.CKs)
 	h := MessageHeader{
@@ -112,11 +218,66 @@ func (s *state) RatchetEncrypt(plaintext []byte, ad AssociatedData) Message {
 		PN: s.PN,
 	}
 	s.Ns++
+	s.SendCountSinceRatchet++
 	ciphertext := s.Crypto.Encrypt(mk, plaintext, h.EncodeWithAD(ad))
+
+	if s.headerEncryption {
+		return Message{
+			EncHeader:  s.Crypto.EncryptHeader(s.HKs, h.Encode()),
+			Ciphertext: ciphertext,
+		}, nil
+	}
 	return Message{
 		Header:     h,
 		Ciphertext: ciphertext,
+	}, nil
+}
+
+// ratchetPolicyDue reports whether the configured WithRatchetPolicy thresholds call for a
+// self-initiated DH ratchet step before the next message is sent.
+func (s *state) ratchetPolicyDue() bool {
+	if s.RatchetMaxMessages > 0 && s.SendCountSinceRatchet >= s.RatchetMaxMessages {
+		return true
 	}
+	if s.RatchetMaxAge > 0 && time.Since(s.LastRatchetAt) >= s.RatchetMaxAge {
+		return true
+	}
+	return false
+}
+
+// selfRatchet regenerates DHs and rolls the sending chain forward against the peer key in DHr.
+// It's called both for the sending half of a peer-triggered ratchet step (dhRatchet sets
+// sendRatchetRequired rather than doing this itself) and for a WithRatchetPolicy-triggered
+// self-initiated one.
+//
+// Deriving CKs here requires DHr to still be a key the peer can reproduce the same DH output
+// against. dhRatchet deliberately leaves regenerating our own DHs/CKs to this function instead of
+// doing it eagerly itself: if it regenerated them immediately on every receive, our sending key
+// would silently move ahead of whatever the peer last saw from us, so a later self-initiated
+// ratchet step computed here against their DHr (the last key we actually heard from them, never
+// changed except by dhRatchet) could diverge from the DH output they'd compute on their end, since
+// their own equivalent regeneration may equally be deferred. Keeping both sides' regeneration tied
+// to the moment they next actually send keeps whatever the peer stored as our DHr accurate.
+func (s *state) selfRatchet() error {
+	s.PN = s.Ns
+	s.Ns = 0
+
+	var err error
+	s.DHs, err = s.Crypto.GenerateDH()
+	if err != nil {
+		return fmt.Errorf("failed to generate dh pair: %s", err)
+	}
+	dhOuts := s.Crypto.DH(s.DHs, s.DHr)
+	s.RK, s.CKs = s.Crypto.KdfRK(s.RK, dhOuts)
+	if s.headerEncryption {
+		s.HKs = s.NHKs
+		_, s.NHKs = s.Crypto.KdfRK(s.RK, dhOuts)
+	}
+
+	s.sendRatchetRequired = false
+	s.LastRatchetAt = time.Now()
+	s.SendCountSinceRatchet = 0
+	return nil
 }
 
 // RatchetDecrypt is called to decrypt messages.
@@ -124,8 +285,13 @@ func (s *state) RatchetDecrypt(m Message, ad AssociatedData) ([]byte, error) {
 	// All changes must be applied on a different state object, so that this state won't be modified nor left in a dirty state.
 	var sc state = *s
 
+	h, isNewRatchet, err := sc.resolveHeader(m)
+	if err != nil {
+		return nil, fmt.Errorf("can't resolve header: %s", err)
+	}
+
 	// Is the messages one of the skipped?
-	plaintext, err := sc.trySkippedMessageKeys(m, ad)
+	plaintext, err := sc.trySkippedMessageKeys(m, h, ad)
 	if err != nil {
 		return nil, fmt.Errorf("can't try skipped message: %s", err)
 	}
@@ -134,23 +300,23 @@ func (s *state) RatchetDecrypt(m Message, ad AssociatedData) ([]byte, error) {
 	}
 
 	// Is there a new ratchet key?
-	if m.Header.DH != sc.DHr {
-		if err := sc.skipMessageKeys(m.Header.PN); err != nil {
+	if isNewRatchet {
+		if err := sc.skipMessageKeys(h.PN); err != nil {
 			return nil, fmt.Errorf("failed to skip previous chain message keys: %s", err)
 		}
-		if err := sc.dhRatchet(m.Header); err != nil {
+		if err := sc.dhRatchet(h); err != nil {
 			return nil, fmt.Errorf("failed to perform ratchet step: %s", err)
 		}
 	}
 
 	// After all, apply changes on the current chain.
-	if err := sc.skipMessageKeys(m.Header.N); err != nil {
+	if err := sc.skipMessageKeys(h.N); err != nil {
 		return nil, fmt.Errorf("failed to skip current chain message keys: %s", err)
 	}
 	var mk [32]byte
 	sc.CKr, mk = sc.Crypto.KdfCK(sc.CKr)
 	sc.Nr++
-	plaintext, err = sc.Crypto.Decrypt(mk, m.Ciphertext, m.Header.EncodeWithAD(ad))
+	plaintext, err = sc.Crypto.Decrypt(mk, m.Ciphertext, h.EncodeWithAD(ad))
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt: %s", err)
 	}
@@ -160,23 +326,94 @@ func (s *state) RatchetDecrypt(m Message, ad AssociatedData) ([]byte, error) {
 	return plaintext, nil
 }
 
+// Encode serializes m using the session's Codec, see WithCodec.
+func (s *state) Encode(m Message) ([]byte, error) {
+	return s.Codec.Encode(m)
+}
+
+// Decode parses a blob produced by Encode back into a Message.
+func (s *state) Decode(b []byte) (Message, error) {
+	return s.Codec.Decode(b)
+}
+
+// resolveHeader recovers the message's header and reports whether it belongs to a new
+// (not yet ratcheted-to) sending chain. In header encryption mode the header arrives
+// encrypted, so it must be decrypted with HKr first, falling back to NHKr to detect
+// that the peer has started a new ratchet, and finally to every header key a skipped
+// message key was ever stored under, to recover a message delayed by more than one
+// ratchet step.
+func (s *state) resolveHeader(m Message) (h MessageHeader, isNewRatchet bool, err error) {
+	if !s.headerEncryption {
+		return m.Header, m.Header.DH != s.DHr, nil
+	}
+
+	if raw, err := s.Crypto.DecryptHeader(s.HKr, m.EncHeader); err == nil {
+		h, err := decodeMessageHeader(raw)
+		return h, false, err
+	}
+	if raw, err := s.Crypto.DecryptHeader(s.NHKr, m.EncHeader); err == nil {
+		h, err := decodeMessageHeader(raw)
+		return h, true, err
+	}
+	for _, hk := range s.headerKeysSeen {
+		raw, err := s.Crypto.DecryptHeader(hk, m.EncHeader)
+		if err != nil {
+			continue
+		}
+		h, err := decodeMessageHeader(raw)
+		return h, false, err
+	}
+	return MessageHeader{}, false, fmt.Errorf("header doesn't decrypt with HKr, NHKr, nor any skipped header key")
+}
+
 // trySkippedMessageKeys tries to decrypt the message with a skipped message key.
-func (s *state) trySkippedMessageKeys(m Message, ad AssociatedData) ([]byte, error) {
-	k := s.skippedKey(m.Header.DH[:], m.Header.N)
-	if mk, ok := s.MkSkipped[k]; ok {
-		plaintext, err := s.Crypto.Decrypt(mk, m.Ciphertext, m.Header.EncodeWithAD(ad))
+func (s *state) trySkippedMessageKeys(m Message, h MessageHeader, ad AssociatedData) ([]byte, error) {
+	if !s.headerEncryption {
+		mk, ok, err := s.KeysStorage.Get(s.ID, h.DH, h.N)
+		if err != nil {
+			return nil, fmt.Errorf("can't get skipped message key: %s", err)
+		}
+		if !ok {
+			return nil, nil
+		}
+		plaintext, err := s.Crypto.Decrypt(mk, m.Ciphertext, h.EncodeWithAD(ad))
 		if err != nil {
 			return nil, fmt.Errorf("can't decrypt message: %s", err)
 		}
-		delete(s.MkSkipped, k)
+		if err := s.KeysStorage.DeleteMk(s.ID, h.DH, h.N); err != nil {
+			return nil, fmt.Errorf("can't delete skipped message key: %s", err)
+		}
 		return plaintext, nil
 	}
-	return nil, nil
-}
 
-// skippedKey forms a key for a skipped message.
-func (s *state) skippedKey(dh []byte, n uint) string {
-	return fmt.Sprintf("%s%d", hex.EncodeToString(dh), n)
+	// The header is encrypted, so we can't compute its (HK, N) key directly: trial-decrypt
+	// it with every header key we've ever skipped under, until one of them works.
+	for _, hk := range s.headerKeysSeen {
+		raw, err := s.Crypto.DecryptHeader(hk, m.EncHeader)
+		if err != nil {
+			continue
+		}
+		sh, err := decodeMessageHeader(raw)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode skipped header: %s", err)
+		}
+		mk, ok, err := s.KeysStorage.Get(s.ID, hk, sh.N)
+		if err != nil {
+			return nil, fmt.Errorf("can't get skipped message key: %s", err)
+		}
+		if !ok {
+			continue
+		}
+		plaintext, err := s.Crypto.Decrypt(mk, m.Ciphertext, sh.EncodeWithAD(ad))
+		if err != nil {
+			return nil, fmt.Errorf("can't decrypt message: %s", err)
+		}
+		if err := s.KeysStorage.DeleteMk(s.ID, hk, sh.N); err != nil {
+			return nil, fmt.Errorf("can't delete skipped message key: %s", err)
+		}
+		return plaintext, nil
+	}
+	return nil, nil
 }
 
 // skipMessageKeys skips message keys in the current receiving chain.
@@ -185,28 +422,55 @@ func (s *state) skipMessageKeys(until uint) error {
 	if s.Nr+s.MaxSkip < until {
 		return fmt.Errorf("too many messages: %d", until-s.Nr)
 	}
+	hk := s.DHr
+	if s.headerEncryption {
+		hk = s.HKr
+		s.rememberHeaderKey(hk)
+	}
 	for s.Nr < until {
 		var mk [32]byte
 		s.CKr, mk = s.Crypto.KdfCK(s.CKr)
-		s.MkSkipped[s.skippedKey(s.DHr[:], s.Nr)] = mk
+		if err := s.KeysStorage.Put(s.ID, hk, s.Nr, mk); err != nil {
+			return fmt.Errorf("can't store skipped message key: %s", err)
+		}
 		s.Nr++
 	}
 	return nil
 }
 
-// dhRatchet performs a single ratchet step.
-func (s *state) dhRatchet(mh MessageHeader) error {
-	var err error
+// rememberHeaderKey records hk so a later skipped message encrypted under it can be found.
+func (s *state) rememberHeaderKey(hk [32]byte) {
+	for _, seen := range s.headerKeysSeen {
+		if seen == hk {
+			return
+		}
+	}
+	s.headerKeysSeen = append(s.headerKeysSeen, hk)
+}
 
-	s.PN = s.Ns
-	s.Ns = 0
+// dhRatchet performs the receiving half of a ratchet step: it rotates DHr onto the peer's new key
+// and rolls the receiving chain forward. Message keys skipped on the chain being abandoned stay in
+// KeysStorage under the old DHr (or HKr): they're still addressable by that public key and get
+// cleaned up individually as trySkippedMessageKeys consumes them.
+//
+// It deliberately leaves the matching sending-half step (generating our own new DHs and rolling
+// CKs forward) to selfRatchet instead of performing it here: doing it here, eagerly, would
+// regenerate our sending key before we've sent anything using it, so the peer would have no way of
+// knowing their cached copy of our public key had gone stale. Setting sendRatchetRequired instead
+// makes the next RatchetEncrypt perform that step right before it transmits the new key in the
+// message header, so a peer never needs to guess at a key it hasn't been told about. See
+// selfRatchet's comment for the full reasoning.
+func (s *state) dhRatchet(mh MessageHeader) error {
 	s.Nr = 0
 	s.DHr = mh.DH
-	s.RK, s.CKr = s.Crypto.KdfRK(s.RK, s.Crypto.DH(s.DHs, s.DHr))
-	s.DHs, err = s.Crypto.GenerateDH()
-	if err != nil {
-		return fmt.Errorf("failed to generate dh pair: %s", err)
+
+	dhOutr := s.Crypto.DH(s.DHs, s.DHr)
+	s.RK, s.CKr = s.Crypto.KdfRK(s.RK, dhOutr)
+	if s.headerEncryption {
+		s.HKr = s.NHKr
+		_, s.NHKr = s.Crypto.KdfRK(s.RK, dhOutr)
 	}
-	s.RK, s.CKs = s.Crypto.KdfRK(s.RK, s.Crypto.DH(s.DHs, s.DHr))
+
+	s.sendRatchetRequired = true
 	return nil
 }
@@ -0,0 +1,114 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestPair(t *testing.T, opts ...Option) (alice, bob State) {
+	t.Helper()
+	sharedKey := [32]byte{7}
+
+	bob, err := New(sharedKey, opts...)
+	if err != nil {
+		t.Fatalf("failed to create bob: %s", err)
+	}
+	bobPub := bob.(*state).DHs.PublicKey()
+
+	alice, err = New(sharedKey, append([]Option{WithRemoteKey(bobPub)}, opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create alice: %s", err)
+	}
+	return alice, bob
+}
+
+func TestRatchetRoundTrip(t *testing.T) {
+	alice, bob := newTestPair(t)
+	ad := AssociatedData("ad")
+
+	m1, err := alice.RatchetEncrypt([]byte("hello bob"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt: %s", err)
+	}
+	pt1, err := bob.RatchetDecrypt(m1, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(pt1, []byte("hello bob")) {
+		t.Fatalf("bob got %q, want %q", pt1, "hello bob")
+	}
+
+	m2, err := bob.RatchetEncrypt([]byte("hello alice"), ad)
+	if err != nil {
+		t.Fatalf("bob failed to encrypt: %s", err)
+	}
+	pt2, err := alice.RatchetDecrypt(m2, ad)
+	if err != nil {
+		t.Fatalf("alice failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(pt2, []byte("hello alice")) {
+		t.Fatalf("alice got %q, want %q", pt2, "hello alice")
+	}
+}
+
+func TestRatchetOutOfOrderDelivery(t *testing.T) {
+	alice, bob := newTestPair(t)
+	ad := AssociatedData("ad")
+
+	m1, err := alice.RatchetEncrypt([]byte("first"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt m1: %s", err)
+	}
+	m2, err := alice.RatchetEncrypt([]byte("second"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt m2: %s", err)
+	}
+
+	// Bob receives m2 before m1: decrypting it must skip and store the message key for m1.
+	pt2, err := bob.RatchetDecrypt(m2, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt m2: %s", err)
+	}
+	if !bytes.Equal(pt2, []byte("second")) {
+		t.Fatalf("bob got %q, want %q", pt2, "second")
+	}
+
+	pt1, err := bob.RatchetDecrypt(m1, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt skipped m1: %s", err)
+	}
+	if !bytes.Equal(pt1, []byte("first")) {
+		t.Fatalf("bob got %q, want %q", pt1, "first")
+	}
+}
+
+func TestSessionStorageRoundTrip(t *testing.T) {
+	alice, bob := newTestPair(t, WithSessionID("alice-bob"))
+	ad := AssociatedData("ad")
+
+	m1, err := alice.RatchetEncrypt([]byte("before snapshot"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt: %s", err)
+	}
+	if _, err := bob.RatchetDecrypt(m1, ad); err != nil {
+		t.Fatalf("bob failed to decrypt: %s", err)
+	}
+
+	snap := bob.Snapshot()
+	restoredBob, err := FromSnapshot(snap, newMemoryKeysStorage())
+	if err != nil {
+		t.Fatalf("failed to restore bob from snapshot: %s", err)
+	}
+
+	m2, err := alice.RatchetEncrypt([]byte("after snapshot"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt: %s", err)
+	}
+	pt2, err := restoredBob.RatchetDecrypt(m2, ad)
+	if err != nil {
+		t.Fatalf("restored bob failed to decrypt: %s", err)
+	}
+	if !bytes.Equal(pt2, []byte("after snapshot")) {
+		t.Fatalf("restored bob got %q, want %q", pt2, "after snapshot")
+	}
+}
@@ -0,0 +1,238 @@
+// Package x3dh implements the key agreement described in
+// https://signal.org/docs/specifications/x3dh/, so two parties can derive the sharedKey that
+// doubleratchet.New requires without hand-rolling the handshake themselves.
+package x3dh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// IdentityKey is a party's long-term identity: a Curve25519 key pair for Diffie-Hellman, and an
+// Ed25519 key pair used to sign that party's signed prekey.
+type IdentityKey struct {
+	DHPrivate [32]byte
+	DHPublic  [32]byte
+
+	SignPublic  ed25519.PublicKey
+	signPrivate ed25519.PrivateKey
+}
+
+// GenerateIdentityKey generates a new identity key pair.
+func GenerateIdentityKey() (IdentityKey, error) {
+	signPub, signPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return IdentityKey{}, fmt.Errorf("failed to generate signing key: %s", err)
+	}
+	dhPriv, dhPub, err := generateDH()
+	if err != nil {
+		return IdentityKey{}, fmt.Errorf("failed to generate dh key: %s", err)
+	}
+	return IdentityKey{
+		DHPrivate:   dhPriv,
+		DHPublic:    dhPub,
+		SignPublic:  signPub,
+		signPrivate: signPriv,
+	}, nil
+}
+
+// SignedPreKey is a medium-term Curve25519 key pair, signed by its owner's IdentityKey so the
+// other party can authenticate it.
+type SignedPreKey struct {
+	Private   [32]byte
+	Public    [32]byte
+	Signature []byte
+}
+
+// GenerateSignedPreKey generates a new signed prekey for identity.
+func GenerateSignedPreKey(identity IdentityKey) (SignedPreKey, error) {
+	priv, pub, err := generateDH()
+	if err != nil {
+		return SignedPreKey{}, fmt.Errorf("failed to generate dh key: %s", err)
+	}
+	return SignedPreKey{
+		Private:   priv,
+		Public:    pub,
+		Signature: ed25519.Sign(identity.signPrivate, pub[:]),
+	}, nil
+}
+
+// OneTimePreKey is a single-use Curve25519 key pair. A responder publishes a batch of these and
+// discards each one once an initiator's InitMessage reports having used it.
+type OneTimePreKey struct {
+	Private [32]byte
+	Public  [32]byte
+}
+
+// GenerateOneTimePreKeys generates n fresh one-time prekeys.
+func GenerateOneTimePreKeys(n int) ([]OneTimePreKey, error) {
+	keys := make([]OneTimePreKey, n)
+	for i := range keys {
+		priv, pub, err := generateDH()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate dh key: %s", err)
+		}
+		keys[i] = OneTimePreKey{Private: priv, Public: pub}
+	}
+	return keys, nil
+}
+
+// Bundle is what a responder publishes (e.g. to a server) for initiators to fetch and start a
+// session against.
+type Bundle struct {
+	IdentityKey   [32]byte
+	SigningKey    ed25519.PublicKey
+	SignedPreKey  [32]byte
+	Signature     []byte
+	OneTimePreKey *[32]byte // nil if none was available.
+}
+
+// Bundle returns the publishable bundle for a responder holding identity, signedPreKey and,
+// optionally, one of their one-time prekeys.
+func (identity IdentityKey) Bundle(signedPreKey SignedPreKey, oneTimePreKey *OneTimePreKey) Bundle {
+	b := Bundle{
+		IdentityKey:  identity.DHPublic,
+		SigningKey:   identity.SignPublic,
+		SignedPreKey: signedPreKey.Public,
+		Signature:    signedPreKey.Signature,
+	}
+	if oneTimePreKey != nil {
+		pub := oneTimePreKey.Public
+		b.OneTimePreKey = &pub
+	}
+	return b
+}
+
+// InitMessage is what an initiator sends a responder to complete the handshake and bootstrap a
+// Double Ratchet session, typically alongside the first encrypted message.
+type InitMessage struct {
+	IdentityKey       [32]byte
+	EphemeralKey      [32]byte
+	UsedOneTimePreKey *[32]byte // nil if the responder's bundle had none.
+}
+
+// InitiatorHandshake performs the initiator's (Alice's) side of X3DH against theirBundle,
+// published by the responder. The returned sharedKey and initialMessage can be used as-is in
+// doubleratchet.New(sharedKey) and sent to the responder respectively; the responder recovers the
+// same sharedKey and the DH public key to ratchet against from ResponderHandshake. ownKey is the
+// private half of initialMessage.EphemeralKey: the initiator must seed their Double Ratchet
+// session with it via doubleratchet.New(sharedKey, doubleratchet.WithOwnKeyPair(ownKey)), since
+// ResponderHandshake's remoteDH is this same ephemeral public key and the two sides' DH ratchets
+// only line up if the initiator's own keypair is the one X3DH already committed to.
+func InitiatorHandshake(theirBundle Bundle, myIdentity IdentityKey) (sharedKey [32]byte, ownKey [32]byte, initialMessage InitMessage, err error) {
+	if !ed25519.Verify(theirBundle.SigningKey, theirBundle.SignedPreKey[:], theirBundle.Signature) {
+		return sharedKey, ownKey, initialMessage, fmt.Errorf("signed prekey signature doesn't verify")
+	}
+
+	ephPriv, ephPub, err := generateDH()
+	if err != nil {
+		return sharedKey, ownKey, initialMessage, fmt.Errorf("failed to generate ephemeral key: %s", err)
+	}
+
+	dh1 := dh(myIdentity.DHPrivate, theirBundle.SignedPreKey)
+	dh2 := dh(ephPriv, theirBundle.IdentityKey)
+	dh3 := dh(ephPriv, theirBundle.SignedPreKey)
+	concatenated := concat(dh1, dh2, dh3)
+
+	initialMessage = InitMessage{
+		IdentityKey:  myIdentity.DHPublic,
+		EphemeralKey: ephPub,
+	}
+	if theirBundle.OneTimePreKey != nil {
+		dh4 := dh(ephPriv, *theirBundle.OneTimePreKey)
+		concatenated = append(concatenated, dh4[:]...)
+		otpk := *theirBundle.OneTimePreKey
+		initialMessage.UsedOneTimePreKey = &otpk
+	}
+
+	return kdf(concatenated), ephPriv, initialMessage, nil
+}
+
+// ResponderKeys are the private keys a responder (Bob) needs to complete their side of X3DH.
+// OneTimePreKeys should be whichever of the responder's currently-published one-time prekeys are
+// still unused; the caller is responsible for removing the one the InitMessage's
+// UsedOneTimePreKey names.
+type ResponderKeys struct {
+	Identity       IdentityKey
+	SignedPreKey   SignedPreKey
+	OneTimePreKeys []OneTimePreKey
+}
+
+// ResponderHandshake performs the responder's (Bob's) side of X3DH against an InitMessage
+// received from the initiator. The returned remoteDH is the initiator's initial ratchet public
+// key, i.e. the public half of the ownKey InitiatorHandshake returned: feed both results into
+// doubleratchet.New(sharedKey, doubleratchet.WithRemoteKey(remoteDH)).
+func ResponderHandshake(myKeys ResponderKeys, initMessage InitMessage) (sharedKey [32]byte, remoteDH [32]byte, err error) {
+	dh1 := dh(myKeys.SignedPreKey.Private, initMessage.IdentityKey)
+	dh2 := dh(myKeys.Identity.DHPrivate, initMessage.EphemeralKey)
+	dh3 := dh(myKeys.SignedPreKey.Private, initMessage.EphemeralKey)
+	concatenated := concat(dh1, dh2, dh3)
+
+	if initMessage.UsedOneTimePreKey != nil {
+		otpk, ok := findOneTimePreKey(myKeys.OneTimePreKeys, *initMessage.UsedOneTimePreKey)
+		if !ok {
+			return sharedKey, remoteDH, fmt.Errorf("one-time prekey used by initiator is unknown")
+		}
+		dh4 := dh(otpk.Private, initMessage.EphemeralKey)
+		concatenated = append(concatenated, dh4[:]...)
+	}
+
+	return kdf(concatenated), initMessage.EphemeralKey, nil
+}
+
+func findOneTimePreKey(keys []OneTimePreKey, pub [32]byte) (OneTimePreKey, bool) {
+	for _, k := range keys {
+		if k.Public == pub {
+			return k, true
+		}
+	}
+	return OneTimePreKey{}, false
+}
+
+func concat(keys ...[32]byte) []byte {
+	buf := make([]byte, 0, len(keys)*32)
+	for _, k := range keys {
+		buf = append(buf, k[:]...)
+	}
+	return buf
+}
+
+// kdf derives the 32-byte sharedKey from the concatenated DH outputs via HKDF-SHA256.
+func kdf(concatenated []byte) [32]byte {
+	r := hkdf.New(sha256.New, concatenated, nil, []byte("doubleratchet X3DH"))
+	var sharedKey [32]byte
+	io.ReadFull(r, sharedKey[:])
+	return sharedKey
+}
+
+func generateDH() (priv, pub [32]byte, err error) {
+	if _, err := io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return priv, pub, fmt.Errorf("failed to read random bytes: %s", err)
+	}
+	priv[0] &= 248
+	priv[31] &= 127
+	priv[31] |= 64
+
+	pubSlice, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return priv, pub, fmt.Errorf("failed to compute public key: %s", err)
+	}
+	copy(pub[:], pubSlice)
+	return priv, pub, nil
+}
+
+func dh(priv, pub [32]byte) [32]byte {
+	shared, err := curve25519.X25519(priv[:], pub[:])
+	if err != nil {
+		panic(fmt.Sprintf("failed to compute dh: %s", err))
+	}
+	var out [32]byte
+	copy(out[:], shared)
+	return out
+}
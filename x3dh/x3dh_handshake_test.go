@@ -0,0 +1,78 @@
+package x3dh_test
+
+import (
+	"bytes"
+	"testing"
+
+	"doubleratchet"
+	"doubleratchet/x3dh"
+)
+
+// TestHandshakeBootstrapsWorkingRatchetSession checks that the values InitiatorHandshake and
+// ResponderHandshake hand back actually produce a working Double Ratchet session, not just a
+// matching sharedKey: the initiator must seed their own keypair via WithOwnKeyPair(ownKey) for
+// their first message's header to match what WithRemoteKey(remoteDH) already committed the
+// responder to.
+func TestHandshakeBootstrapsWorkingRatchetSession(t *testing.T) {
+	bobIdentity, err := x3dh.GenerateIdentityKey()
+	if err != nil {
+		t.Fatalf("failed to generate bob's identity key: %s", err)
+	}
+	bobSignedPreKey, err := x3dh.GenerateSignedPreKey(bobIdentity)
+	if err != nil {
+		t.Fatalf("failed to generate bob's signed prekey: %s", err)
+	}
+	bundle := bobIdentity.Bundle(bobSignedPreKey, nil)
+
+	aliceIdentity, err := x3dh.GenerateIdentityKey()
+	if err != nil {
+		t.Fatalf("failed to generate alice's identity key: %s", err)
+	}
+
+	aliceSharedKey, aliceOwnKey, initMessage, err := x3dh.InitiatorHandshake(bundle, aliceIdentity)
+	if err != nil {
+		t.Fatalf("initiator handshake failed: %s", err)
+	}
+
+	bobSharedKey, remoteDH, err := x3dh.ResponderHandshake(x3dh.ResponderKeys{
+		Identity:     bobIdentity,
+		SignedPreKey: bobSignedPreKey,
+	}, initMessage)
+	if err != nil {
+		t.Fatalf("responder handshake failed: %s", err)
+	}
+
+	alice, err := doubleratchet.New(aliceSharedKey, doubleratchet.WithOwnKeyPair(aliceOwnKey))
+	if err != nil {
+		t.Fatalf("failed to create alice's session: %s", err)
+	}
+	bob, err := doubleratchet.New(bobSharedKey, doubleratchet.WithRemoteKey(remoteDH))
+	if err != nil {
+		t.Fatalf("failed to create bob's session: %s", err)
+	}
+
+	ad := doubleratchet.AssociatedData("x3dh handshake")
+	m, err := alice.RatchetEncrypt([]byte("hello bob"), ad)
+	if err != nil {
+		t.Fatalf("alice failed to encrypt: %s", err)
+	}
+	plaintext, err := bob.RatchetDecrypt(m, ad)
+	if err != nil {
+		t.Fatalf("bob failed to decrypt alice's first message: %s", err)
+	}
+	if !bytes.Equal(plaintext, []byte("hello bob")) {
+		t.Fatalf("bob got %q, want %q", plaintext, "hello bob")
+	}
+
+	reply, err := bob.RatchetEncrypt([]byte("hello alice"), ad)
+	if err != nil {
+		t.Fatalf("bob failed to encrypt reply: %s", err)
+	}
+	plaintext, err = alice.RatchetDecrypt(reply, ad)
+	if err != nil {
+		t.Fatalf("alice failed to decrypt bob's reply: %s", err)
+	}
+	if !bytes.Equal(plaintext, []byte("hello alice")) {
+		t.Fatalf("alice got %q, want %q", plaintext, "hello alice")
+	}
+}
@@ -0,0 +1,105 @@
+package x3dh
+
+import "testing"
+
+func TestHandshakeAgreementWithOneTimePreKey(t *testing.T) {
+	bobIdentity, err := GenerateIdentityKey()
+	if err != nil {
+		t.Fatalf("failed to generate bob's identity key: %s", err)
+	}
+	bobSignedPreKey, err := GenerateSignedPreKey(bobIdentity)
+	if err != nil {
+		t.Fatalf("failed to generate bob's signed prekey: %s", err)
+	}
+	bobOneTimePreKeys, err := GenerateOneTimePreKeys(1)
+	if err != nil {
+		t.Fatalf("failed to generate bob's one-time prekeys: %s", err)
+	}
+	bundle := bobIdentity.Bundle(bobSignedPreKey, &bobOneTimePreKeys[0])
+
+	aliceIdentity, err := GenerateIdentityKey()
+	if err != nil {
+		t.Fatalf("failed to generate alice's identity key: %s", err)
+	}
+
+	aliceSharedKey, _, initMessage, err := InitiatorHandshake(bundle, aliceIdentity)
+	if err != nil {
+		t.Fatalf("initiator handshake failed: %s", err)
+	}
+
+	bobSharedKey, remoteDH, err := ResponderHandshake(ResponderKeys{
+		Identity:       bobIdentity,
+		SignedPreKey:   bobSignedPreKey,
+		OneTimePreKeys: bobOneTimePreKeys,
+	}, initMessage)
+	if err != nil {
+		t.Fatalf("responder handshake failed: %s", err)
+	}
+
+	if aliceSharedKey != bobSharedKey {
+		t.Fatalf("shared keys don't match: alice got %x, bob got %x", aliceSharedKey, bobSharedKey)
+	}
+	if remoteDH != initMessage.EphemeralKey {
+		t.Fatalf("remoteDH %x doesn't match initiator's ephemeral key %x", remoteDH, initMessage.EphemeralKey)
+	}
+}
+
+func TestHandshakeAgreementWithoutOneTimePreKey(t *testing.T) {
+	bobIdentity, err := GenerateIdentityKey()
+	if err != nil {
+		t.Fatalf("failed to generate bob's identity key: %s", err)
+	}
+	bobSignedPreKey, err := GenerateSignedPreKey(bobIdentity)
+	if err != nil {
+		t.Fatalf("failed to generate bob's signed prekey: %s", err)
+	}
+	bundle := bobIdentity.Bundle(bobSignedPreKey, nil)
+
+	aliceIdentity, err := GenerateIdentityKey()
+	if err != nil {
+		t.Fatalf("failed to generate alice's identity key: %s", err)
+	}
+
+	aliceSharedKey, _, initMessage, err := InitiatorHandshake(bundle, aliceIdentity)
+	if err != nil {
+		t.Fatalf("initiator handshake failed: %s", err)
+	}
+	if initMessage.UsedOneTimePreKey != nil {
+		t.Fatalf("initMessage.UsedOneTimePreKey = %x, want nil", *initMessage.UsedOneTimePreKey)
+	}
+
+	bobSharedKey, _, err := ResponderHandshake(ResponderKeys{
+		Identity:     bobIdentity,
+		SignedPreKey: bobSignedPreKey,
+	}, initMessage)
+	if err != nil {
+		t.Fatalf("responder handshake failed: %s", err)
+	}
+
+	if aliceSharedKey != bobSharedKey {
+		t.Fatalf("shared keys don't match: alice got %x, bob got %x", aliceSharedKey, bobSharedKey)
+	}
+}
+
+func TestInitiatorHandshakeRejectsBadSignature(t *testing.T) {
+	bobIdentity, err := GenerateIdentityKey()
+	if err != nil {
+		t.Fatalf("failed to generate bob's identity key: %s", err)
+	}
+	bobSignedPreKey, err := GenerateSignedPreKey(bobIdentity)
+	if err != nil {
+		t.Fatalf("failed to generate bob's signed prekey: %s", err)
+	}
+	bundle := bobIdentity.Bundle(bobSignedPreKey, nil)
+	bundle.Signature = append([]byte(nil), bundle.Signature...)
+	bundle.Signature[0] ^= 0xff
+
+	aliceIdentity, err := GenerateIdentityKey()
+	if err != nil {
+		t.Fatalf("failed to generate alice's identity key: %s", err)
+	}
+
+	if _, _, _, err := InitiatorHandshake(bundle, aliceIdentity); err == nil {
+		t.Fatal("expected an error for a bad signed prekey signature, got nil")
+	}
+}